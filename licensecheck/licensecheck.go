@@ -0,0 +1,106 @@
+// Package licensecheck verifies Elm-pair license keys offline using the
+// licensing server's Ed25519 public keys, so components can validate a
+// license without reaching the licensing server on every run.
+package licensecheck
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// License mirrors the payload embedded in a v2 license key.
+type License struct {
+	KeyID     string   `json:"kid"`
+	OrderID   string   `json:"orderId"`
+	IssuedAt  int64    `json:"issuedAt"`
+	ExpiresAt int64    `json:"expiresAt"`
+	Tier      string   `json:"tier"`
+	Seats     int      `json:"seats"`
+	Features  []string `json:"features"`
+}
+
+// KeyLookup returns the Ed25519 public key identified by kid, or false if
+// kid is unknown. Callers typically back this with a JWKS document fetched
+// from the licensing server's /v1/keys endpoint.
+type KeyLookup func(kid string) (ed25519.PublicKey, bool)
+
+// Verify checks the signature and expiry of a v2 license key and returns the
+// embedded License on success. The key used to sign the license is looked
+// up by its embedded kid, so verifiers can keep validating licenses signed
+// by keys the server has since rotated away from. It does not consult the
+// licensing server's revocation list; callers that care about revocation
+// should combine Verify with an occasional CheckOnline call.
+func Verify(lookup KeyLookup, licenseKey string) (License, error) {
+	const prefix = "v2-"
+	if !strings.HasPrefix(licenseKey, prefix) {
+		return License{}, errors.New("not a v2 license key")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(licenseKey, prefix), ".", 2)
+	if len(parts) != 2 {
+		return License{}, errors.New("malformed license key")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return License{}, fmt.Errorf("invalid license payload: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return License{}, fmt.Errorf("invalid license signature: %w", err)
+	}
+
+	var license License
+	if err := json.Unmarshal(payload, &license); err != nil {
+		return License{}, fmt.Errorf("invalid license payload: %w", err)
+	}
+
+	pubKey, ok := lookup(license.KeyID)
+	if !ok {
+		return License{}, fmt.Errorf("unknown signing key: %s", license.KeyID)
+	}
+
+	if !ed25519.Verify(pubKey, payload, sig) {
+		return License{}, errors.New("invalid license signature")
+	}
+
+	if time.Now().Unix() > license.ExpiresAt {
+		return License{}, errors.New("license expired")
+	}
+
+	return license, nil
+}
+
+// ShouldPhoneHome reports whether enough time has passed since lastChecked
+// to justify another CheckOnline call. Verify already checks signature and
+// expiry offline, so online checks only need to happen occasionally, to
+// catch revocations.
+func ShouldPhoneHome(lastChecked time.Time, cadence time.Duration) bool {
+	return time.Since(lastChecked) >= cadence
+}
+
+// CheckOnline asks the licensing server's /v1/verify endpoint whether
+// licenseKey has been revoked since it was issued.
+func CheckOnline(serverURL, licenseKey string) error {
+	resp, err := http.Get(serverURL + "/v1/verify?key=" + url.QueryEscape(licenseKey))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("license check failed: %s", body)
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SigningKey is one Ed25519 key the licensing server knows about. Keys with
+// a nil Private are verify-only: they keep validating licenses issued
+// before a rotation, but can no longer sign new ones.
+type SigningKey struct {
+	KID       string
+	Private   ed25519.PrivateKey
+	Public    ed25519.PublicKey
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// signingKeyJSON is the on-disk/env-var shape of a signing key entry.
+type signingKeyJSON struct {
+	KID       string    `json:"kid"`
+	PEM       string    `json:"pem"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	Primary   bool      `json:"primary"`
+}
+
+// KeySet holds every signing key the server trusts, and which one is
+// currently primary. Rotating the primary doesn't invalidate licenses
+// signed by the previous one: it just stops using it for new licenses.
+type KeySet struct {
+	mu         sync.RWMutex
+	keys       map[string]*SigningKey
+	primaryKID string
+}
+
+// newKeySetFromEnv loads signing keys from
+// ELM_PAIR_LICENSING_SERVER_SIGNING_KEYS, which is either a path to a
+// directory of key files, or a literal JSON array of key entries.
+func newKeySetFromEnv() (*KeySet, error) {
+	val := os.Getenv("ELM_PAIR_LICENSING_SERVER_SIGNING_KEYS")
+	if val == "" {
+		return nil, errors.New("not set: ELM_PAIR_LICENSING_SERVER_SIGNING_KEYS")
+	}
+
+	var entries []signingKeyJSON
+	if info, err := os.Stat(val); err == nil && info.IsDir() {
+		entries, err = readSigningKeyEntriesFromDir(val)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := json.Unmarshal([]byte(val), &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse ELM_PAIR_LICENSING_SERVER_SIGNING_KEYS: %w", err)
+		}
+	}
+
+	return newKeySet(entries)
+}
+
+func readSigningKeyEntriesFromDir(dir string) ([]signingKeyJSON, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []signingKeyJSON
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var fileEntries []signingKeyJSON
+		if err := json.Unmarshal(data, &fileEntries); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return entries, nil
+}
+
+func newKeySet(entries []signingKeyJSON) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*SigningKey, len(entries))}
+
+	for _, e := range entries {
+		key, err := parseSigningKey(e)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", e.KID, err)
+		}
+		ks.keys[key.KID] = key
+		if e.Primary {
+			if key.Private == nil {
+				return nil, fmt.Errorf("key %s is verify-only and can't be primary", e.KID)
+			}
+			ks.primaryKID = key.KID
+		}
+	}
+
+	if ks.primaryKID == "" {
+		return nil, errors.New("no primary key set in ELM_PAIR_LICENSING_SERVER_SIGNING_KEYS")
+	}
+
+	return ks, nil
+}
+
+func parseSigningKey(e signingKeyJSON) (*SigningKey, error) {
+	block, _ := pem.Decode([]byte(e.PEM))
+	if block == nil {
+		return nil, errors.New("could not parse pem")
+	}
+
+	key := &SigningKey{KID: e.KID, NotBefore: e.NotBefore, NotAfter: e.NotAfter}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		data, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := data.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 private key")
+		}
+		key.Private = priv
+		key.Public = priv.Public().(ed25519.PublicKey)
+	case "PUBLIC KEY":
+		data, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := data.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 public key")
+		}
+		key.Public = pub
+	default:
+		return nil, fmt.Errorf("unsupported pem block type: %s", block.Type)
+	}
+
+	return key, nil
+}
+
+// Primary returns the key new licenses should be signed with.
+func (ks *KeySet) Primary() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[ks.primaryKID]
+}
+
+// Lookup returns the public key for kid, for verifying a license signature.
+// It satisfies licensecheck.KeyLookup.
+func (ks *KeySet) Lookup(kid string) (ed25519.PublicKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, false
+	}
+	return key.Public, true
+}
+
+// All returns every key in the set, ordered by KID, for the JWKS document.
+func (ks *KeySet) All() []*SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := make([]*SigningKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KID < keys[j].KID })
+	return keys
+}
+
+// Rotate promotes the key staged under kid to primary, and clears the
+// outgoing primary's Private so it becomes verify-only: it keeps validating
+// licenses it already signed, but can no longer be rotated back to without
+// reloading its private key from config.
+func (ks *KeySet) Rotate(kid string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return fmt.Errorf("unknown key: %s", kid)
+	}
+	if key.Private == nil {
+		return fmt.Errorf("key %s is verify-only and can't be made primary", kid)
+	}
+
+	if previous, ok := ks.keys[ks.primaryKID]; ok && previous.KID != kid {
+		previous.Private = nil
+	}
+
+	ks.primaryKID = kid
+	return nil
+}
+
+// jwksDocument is the JWKS-like document served at /v1/keys.
+type jwksDocument struct {
+	Keys []jwksKey `json:"keys"`
+}
+
+type jwksKey struct {
+	KID       string `json:"kid"`
+	Alg       string `json:"alg"`
+	Crv       string `json:"crv"`
+	X         string `json:"x"`
+	NotBefore int64  `json:"notBefore,omitempty"`
+	NotAfter  int64  `json:"notAfter,omitempty"`
+}
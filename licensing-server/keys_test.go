@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestKeySetRotateDemotesPreviousPrimaryToVerifyOnly(t *testing.T) {
+	k1Priv := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	k1 := &SigningKey{KID: "k1", Private: k1Priv, Public: k1Priv.Public().(ed25519.PublicKey)}
+
+	k2Seed := make([]byte, ed25519.SeedSize)
+	k2Seed[0] = 1
+	k2Priv := ed25519.NewKeyFromSeed(k2Seed)
+	k2 := &SigningKey{KID: "k2", Private: k2Priv, Public: k2Priv.Public().(ed25519.PublicKey)}
+
+	keySet := &KeySet{keys: map[string]*SigningKey{"k1": k1, "k2": k2}, primaryKID: "k1"}
+
+	if err := keySet.Rotate("k2"); err != nil {
+		t.Fatalf("unexpected error rotating to k2: %s", err)
+	}
+	if keySet.Primary().KID != "k2" {
+		t.Fatalf("got primary %s, want k2", keySet.Primary().KID)
+	}
+
+	pub, ok := keySet.Lookup("k1")
+	if !ok || !pub.Equal(k1.Public) {
+		t.Error("expected k1's public key to still be looked up, so licenses it signed keep verifying")
+	}
+
+	if err := keySet.Rotate("k1"); err == nil {
+		t.Error("expected rotating back to the demoted k1 to fail, since it's now verify-only")
+	}
+}
+
+func TestKeySetRotateRejectsVerifyOnlyKey(t *testing.T) {
+	priv := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	pub := priv.Public().(ed25519.PublicKey)
+	primary := &SigningKey{KID: "primary", Private: priv, Public: pub}
+	verifyOnly := &SigningKey{KID: "verify-only", Public: pub}
+
+	keySet := &KeySet{keys: map[string]*SigningKey{"primary": primary, "verify-only": verifyOnly}, primaryKID: "primary"}
+
+	if err := keySet.Rotate("verify-only"); err == nil {
+		t.Error("expected rotating to a verify-only key to fail")
+	}
+}
+
+func TestKeySetRotateRejectsUnknownKey(t *testing.T) {
+	priv := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	primary := &SigningKey{KID: "primary", Private: priv, Public: priv.Public().(ed25519.PublicKey)}
+	keySet := &KeySet{keys: map[string]*SigningKey{"primary": primary}, primaryKID: "primary"}
+
+	if err := keySet.Rotate("nope"); err == nil {
+		t.Error("expected rotating to an unknown kid to fail")
+	}
+}
@@ -2,26 +2,42 @@ package main
 
 import (
 	"bytes"
-	"crypto"
 	"crypto/ed25519"
-	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/x509"
+	"crypto/subtle"
 	"encoding/base64"
-	"encoding/pem"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"sort"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/jwoudenberg/elm-pair/licensecheck"
+)
+
+// licenseValidityPeriod is how long a freshly issued license stays valid
+// before it needs renewing.
+const licenseValidityPeriod = 365 * 24 * time.Hour
+
+// Tiers a license can be issued for.
+const (
+	TierPersonal   = "personal"
+	TierTeam       = "team"
+	TierEnterprise = "enterprise"
 )
 
+// stripeSignatureTolerance bounds how old a Stripe event's timestamp may be
+// before its signature is rejected as a possible replay.
+const stripeSignatureTolerance = 5 * time.Minute
+
 func main() {
-	pkey, err := readPrivateKeyFromEnv()
+	keySet, err := newKeySetFromEnv()
 	if err != nil {
 		log.Fatal(err)
 		return
@@ -45,185 +61,589 @@ func main() {
 		return
 	}
 
+	adminToken := os.Getenv("ELM_PAIR_LICENSING_SERVER_ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Fatal("not set: ELM_PAIR_LICENSING_SERVER_ADMIN_TOKEN")
+		return
+	}
+
+	revocationListPath := os.Getenv("ELM_PAIR_LICENSING_SERVER_REVOCATION_LIST_PATH")
+	if revocationListPath == "" {
+		log.Fatal("not set: ELM_PAIR_LICENSING_SERVER_REVOCATION_LIST_PATH")
+		return
+	}
+	revocationList := newRevocationList(revocationListPath)
+
+	store, err := newStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	mailer, err := newMailerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	rateLimiter, err := rateLimiterFromEnv()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	httpClient := http.Client{Timeout: 10 * time.Second}
 
-	http.HandleFunc("/v1/ping",
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/ping",
 		func(writer http.ResponseWriter, r *http.Request) {
 			responder := Responder{writer, httpClient, healthChecksIoUuid}
 			responder.success("pong")
 		})
-	http.HandleFunc("/v1/generate-license-key",
+
+	paddleVerifier := PaddleVerifier{paddleKey}
+	paddleHandler := func(writer http.ResponseWriter, r *http.Request) {
+		responder := Responder{writer, httpClient, healthChecksIoUuid}
+		generateLicenseKeyHandler(keySet, paddleVerifier, "paddle", store, mailer, responder, r)
+	}
+	// Kept for existing Paddle webhook configurations; new providers are
+	// registered under /v1/webhooks/{provider}/generate-license-key.
+	mux.HandleFunc("/v1/generate-license-key", paddleHandler)
+	mux.HandleFunc("/v1/webhooks/paddle/generate-license-key", paddleHandler)
+
+	if stripeSecret := os.Getenv("ELM_PAIR_LICENSING_SERVER_STRIPE_SECRET"); stripeSecret != "" {
+		stripeVerifier := StripeVerifier{Secret: stripeSecret, Tolerance: stripeSignatureTolerance}
+		mux.HandleFunc("/v1/webhooks/stripe/generate-license-key",
+			func(writer http.ResponseWriter, r *http.Request) {
+				responder := Responder{writer, httpClient, healthChecksIoUuid}
+				generateLicenseKeyHandler(keySet, stripeVerifier, "stripe", store, mailer, responder, r)
+			})
+	}
+
+	if lemonSqueezySecret := os.Getenv("ELM_PAIR_LICENSING_SERVER_LEMON_SQUEEZY_SECRET"); lemonSqueezySecret != "" {
+		lemonSqueezyVerifier := LemonSqueezyVerifier{Secret: lemonSqueezySecret}
+		mux.HandleFunc("/v1/webhooks/lemonsqueezy/generate-license-key",
+			func(writer http.ResponseWriter, r *http.Request) {
+				responder := Responder{writer, httpClient, healthChecksIoUuid}
+				generateLicenseKeyHandler(keySet, lemonSqueezyVerifier, "lemonsqueezy", store, mailer, responder, r)
+			})
+	}
+
+	mux.HandleFunc("/v1/revoke",
 		func(writer http.ResponseWriter, r *http.Request) {
-			responder := Responder{writer, httpClient, healthChecksIoUuid}
-			generateLicenseKeyHandler(pkey, paddleKey, responder, r)
+			revokeHandler(revocationList, adminToken, writer, r)
+		})
+	mux.HandleFunc("/v1/verify",
+		func(writer http.ResponseWriter, r *http.Request) {
+			verifyHandler(keySet, revocationList, writer, r)
+		})
+	mux.HandleFunc("/v1/keys",
+		func(writer http.ResponseWriter, r *http.Request) {
+			keysHandler(keySet, writer, r)
+		})
+	mux.HandleFunc("/v1/keys/rotate",
+		func(writer http.ResponseWriter, r *http.Request) {
+			rotateKeyHandler(keySet, adminToken, writer, r)
+		})
+	mux.HandleFunc("/v1/orders/",
+		func(writer http.ResponseWriter, r *http.Request) {
+			ordersHandler(store, mailer, adminToken, writer, r)
 		})
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+
+	handler := withRateLimitAndLogging(rateLimiter, StdoutLogSink{}, mux)
+
+	domains := os.Getenv("ELM_PAIR_LICENSING_SERVER_DOMAINS")
+	if domains != "" {
+		log.Fatal(serveWithAutocert(domains, handler))
+		return
+	}
+
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), handler))
 }
 
+// serveWithAutocert serves the registered handlers over HTTPS on :443,
+// obtaining and renewing certificates for domains from Let's Encrypt. It
+// also serves :80 to answer ACME HTTP-01 challenges and redirect plain HTTP
+// traffic to HTTPS. Replaces the need for a separate TLS-terminating proxy
+// in front of the licensing server.
+func serveWithAutocert(domains string, handler http.Handler) error {
+	cacheDir := os.Getenv("ELM_PAIR_LICENSING_SERVER_CACHE_DIR")
+	if cacheDir == "" {
+		return errors.New("not set: ELM_PAIR_LICENSING_SERVER_CACHE_DIR")
+	}
+
+	email := os.Getenv("ELM_PAIR_LICENSING_SERVER_ACME_EMAIL")
+	if email == "" {
+		return errors.New("not set: ELM_PAIR_LICENSING_SERVER_ACME_EMAIL")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(strings.Split(domains, ",")...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+
+	go func() {
+		log.Fatal(http.ListenAndServe(":80", m.HTTPHandler(nil)))
+	}()
+
+	server := &http.Server{
+		Addr:      ":443",
+		TLSConfig: m.TLSConfig(),
+		Handler:   handler,
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// generateLicenseKeyHandler verifies an inbound payment webhook with
+// verifier, then issues a license for the resulting OrderEvent. Issuance is
+// idempotent: if store already has a record for the order, the previously
+// issued key is returned rather than signing a new one. issueLicenseLocked
+// serializes the check-then-act sequence around store per order ID, so two
+// concurrent deliveries of the same webhook (ordinary provider-retry
+// behavior) can't both miss the idempotency check and double-issue. The
+// healthchecks.io ping in w.success fires once the license has been
+// persisted; it does not wait for the license email, which is sent in the
+// background and whose outcome doesn't affect the ping.
 func generateLicenseKeyHandler(
-	pkey ed25519.PrivateKey,
-	paddleKey *rsa.PublicKey,
+	keySet *KeySet,
+	verifier WebhookVerifier,
+	provider string,
+	store Store,
+	mailer Mailer,
 	w Responder,
 	r *http.Request,
 ) {
 	r.Body = http.MaxBytesReader(w.writer, r.Body, 1024*1024)
-	if err := r.ParseForm(); err != nil {
-		w.error("failed to parse formdata")
+	setRequestLogInfo(r, provider, "")
+
+	event, err := verifier.Verify(r)
+	if errors.Is(err, ErrIgnoredEvent) {
+		w.success("ignored")
 		return
 	}
-
-	err := verifyPaddleSig(r.Form, paddleKey)
 	if err != nil {
-		w.error("invalid paddle signature")
+		w.error(fmt.Sprintf("invalid webhook: %s", err))
 		return
 	}
 
-	orderId := r.FormValue("p_order_id")
-	if orderId == "" {
-		w.error("missing p_order_id field")
-		return
-	}
+	setRequestLogInfo(r, provider, event.OrderID)
 
-	eventTimeStr := r.FormValue("event_time")
-	if eventTimeStr == "" {
-		w.error("missing event_time field")
+	if event.OrderID == "" {
+		w.error("missing order id")
 		return
 	}
 
-	layout := "2006-01-02 15:04:05"
-	eventTime, err := time.Parse(layout, eventTimeStr)
+	licenseKey, alreadyIssued, err := issueLicenseLocked(keySet, store, provider, event, r)
 	if err != nil {
-		w.error(fmt.Sprintf("failed to parse event_time %s: %s", eventTimeStr, err))
+		w.error(err.Error())
+		return
+	}
+	if alreadyIssued {
+		w.success(licenseKey)
 		return
 	}
 
-	licenseKey, err := generateLicenseKey(pkey, orderId, eventTime)
-	if err != nil {
-		w.error(fmt.Sprintf("failed to generate license key: %s", err))
+	// Sent off the request goroutine: the license is already persisted, so a
+	// slow SMTP server or the up-to-~15s retry backoff in
+	// sendLicenseEmailWithRetry shouldn't block the webhook response and risk
+	// a provider-side timeout/retry storm. A failure here is logged, not
+	// returned to the caller; ordersHandler's ?resend=true lets support
+	// retry the email manually if that happens.
+	if event.Email != "" {
+		go func() {
+			if err := sendLicenseEmailWithRetry(mailer, event.Email, licenseKey); err != nil {
+				log.Printf("failed to email license key for order %s: %s", event.OrderID, err)
+			}
+		}()
 	}
 
 	w.success(licenseKey)
 }
 
-type Responder struct {
-	writer             http.ResponseWriter
-	httpClient         http.Client
-	healthChecksIoUuid string
+// orderIssuanceLockStripes bounds the number of mutexes
+// issueLicenseLocked stripes order IDs across, so memory doesn't grow with
+// the number of orders a server instance has ever seen.
+const orderIssuanceLockStripes = 256
+
+var orderIssuanceLocks [orderIssuanceLockStripes]sync.Mutex
+
+// lockOrder locks the mutex orderId hashes to and returns a func to unlock
+// it, serializing concurrent operations on the same order ID.
+func lockOrder(orderId string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(orderId))
+	mu := &orderIssuanceLocks[h.Sum32()%orderIssuanceLockStripes]
+	mu.Lock()
+	return mu.Unlock
 }
 
-func (w Responder) success(res string) {
-	url := fmt.Sprintf("https://hc-ping.com/%s", w.healthChecksIoUuid)
-	_, err := w.httpClient.Head(url)
+// issueLicenseLocked looks up event.OrderID in store and, if not already
+// issued, signs and persists a new license key. The lookup, signing and
+// persisting happen under a per-order-ID lock, so two concurrent deliveries
+// of the same webhook can't both pass the idempotency check and sign two
+// different license keys for the same order.
+func issueLicenseLocked(keySet *KeySet, store Store, provider string, event OrderEvent, r *http.Request) (licenseKey string, alreadyIssued bool, err error) {
+	unlock := lockOrder(event.OrderID)
+	defer unlock()
+
+	existing, found, err := store.Get(event.OrderID)
 	if err != nil {
-		log.Println(err)
+		return "", false, fmt.Errorf("failed to look up order %s: %w", event.OrderID, err)
 	}
-	fmt.Fprintf(w.writer, "%s", res)
+	if found {
+		return existing.LicenseKey, true, nil
+	}
+
+	primary := keySet.Primary()
+	if r.URL.Query().Get("format") == "v1" {
+		licenseKey, err = generateLicenseKey(primary, event.OrderID, event.EventTime)
+	} else {
+		license := newLicense(event.OrderID, event.EventTime, tierForProduct(event.ProductID))
+		licenseKey, err = generateLicenseKeyV2(primary, license)
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to generate license key: %w", err)
+	}
+
+	record := OrderRecord{
+		LicenseKey: licenseKey,
+		IssuedAt:   time.Now(),
+		Email:      event.Email,
+		Provider:   provider,
+		RawWebhook: event.Raw,
+	}
+	if err := store.Put(event.OrderID, record); err != nil {
+		return "", false, fmt.Errorf("failed to persist order %s: %w", event.OrderID, err)
+	}
+
+	return licenseKey, false, nil
 }
 
-func (w Responder) error(msg string) {
-	url := fmt.Sprintf("https://hc-ping.com/%s/fail", w.healthChecksIoUuid)
-	log.Println(url)
-	_, err := w.httpClient.Post(url, "text/plain;charset=UTF-8", bytes.NewBuffer([]byte(msg)))
+// ordersHandler looks up the order lodged for orderId, for support use, and
+// optionally resends its license email via ?resend=true.
+func ordersHandler(store Store, mailer Mailer, adminToken string, w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(r, adminToken) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orderId := strings.TrimPrefix(r.URL.Path, "/v1/orders/")
+	if orderId == "" {
+		http.Error(w, "missing order id", http.StatusBadRequest)
+		return
+	}
+
+	record, found, err := store.Get(orderId)
 	if err != nil {
 		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "order not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("resend") == "true" {
+		if record.Email == "" {
+			http.Error(w, "order has no email on file", http.StatusBadRequest)
+			return
+		}
+		if err := sendLicenseEmailWithRetry(mailer, record.Email, record.LicenseKey); err != nil {
+			log.Println(err)
+			http.Error(w, "failed to resend license email", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(record); err != nil {
+		log.Println(err)
 	}
-	http.Error(w.writer, "Internal Server Error", http.StatusInternalServerError)
 }
 
-func generateLicenseKey(pkey ed25519.PrivateKey, orderId string, orderTime time.Time) (string, error) {
-	licenseVersion := 1
-	licenseKey := fmt.Sprintf("%d-%s-%d", licenseVersion, orderId, orderTime.Unix())
-	signature := ed25519.Sign(pkey, []byte(licenseKey))
+// revokeHandler appends orderId to the persisted revocation list, gated by
+// a bearer admin token. Revoked licenses keep verifying their signature and
+// expiry offline, but fail the server-side check in verifyHandler.
+func revokeHandler(revocationList *RevocationList, adminToken string, w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(r, adminToken) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	encodedSignature := base64.StdEncoding.EncodeToString(signature)
-	return fmt.Sprintf("%s-%s", licenseKey, encodedSignature), nil
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "failed to parse formdata", http.StatusBadRequest)
+		return
+	}
+
+	orderId := r.FormValue("order_id")
+	if orderId == "" {
+		http.Error(w, "missing order_id field", http.StatusBadRequest)
+		return
+	}
+
+	if err := revocationList.Revoke(orderId); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "revoked")
 }
 
-func readPrivateKeyFromEnv() (ed25519.PrivateKey, error) {
-	pkeyPem := os.Getenv("ELM_PAIR_LICENSING_SERVER_SIGNING_KEY")
-	if pkeyPem == "" {
-		return nil, errors.New("not set: ELM_PAIR_LICENSING_SERVER_SIGNING_KEY")
+// verifyHandler lets clients check a v2 license key's signature, expiry and
+// revocation status without needing to fetch and cache the key set themselves.
+func verifyHandler(keySet *KeySet, revocationList *RevocationList, w http.ResponseWriter, r *http.Request) {
+	licenseKey := r.URL.Query().Get("key")
+	if licenseKey == "" {
+		http.Error(w, "missing key parameter", http.StatusBadRequest)
+		return
 	}
 
-	pkeyX509, _ := pem.Decode([]byte(pkeyPem))
-	data, err := x509.ParsePKCS8PrivateKey(pkeyX509.Bytes)
+	license, err := licensecheck.Verify(keySet.Lookup, licenseKey)
 	if err != nil {
-		return nil, err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	pkey, ok := data.(ed25519.PrivateKey)
-	if !ok {
-		return nil, errors.New("Could not parse ed25119 private key")
+	revoked, err := revocationList.IsRevoked(license.OrderID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		http.Error(w, "license revoked", http.StatusForbidden)
+		return
 	}
 
-	return pkey, nil
+	if err := json.NewEncoder(w).Encode(license); err != nil {
+		log.Println(err)
+	}
 }
 
-func readPaddleKeyFromEnv() (*rsa.PublicKey, error) {
-	keyPem := os.Getenv("ELM_PAIR_LICENSING_SERVER_PADDLE_KEY")
-	if keyPem == "" {
-		return nil, errors.New("not set: ELM_PAIR_LICENSING_SERVER_PADDLE_KEY")
+// keysHandler serves a JWKS-like document of every key in keySet, so
+// verifiers can fetch and cache the current key set instead of embedding a
+// single public key that a rotation would invalidate.
+func keysHandler(keySet *KeySet, w http.ResponseWriter, r *http.Request) {
+	doc := jwksDocument{}
+	for _, key := range keySet.All() {
+		doc.Keys = append(doc.Keys, jwksKey{
+			KID:       key.KID,
+			Alg:       "EdDSA",
+			Crv:       "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key.Public),
+			NotBefore: unixOrZero(key.NotBefore),
+			NotAfter:  unixOrZero(key.NotAfter),
+		})
 	}
 
-	keyX509, _ := pem.Decode([]byte(keyPem))
-	if keyX509 == nil {
-		return nil, errors.New("Could not parse paddle key pem")
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		log.Println(err)
 	}
+}
 
-	pub, err := x509.ParsePKIXPublicKey(keyX509.Bytes)
-	if err != nil {
-		return nil, errors.New("Could not parse paddle key x509")
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
 	}
+	return t.Unix()
+}
 
-	key, ok := pub.(*rsa.PublicKey)
-	if !ok {
-		return nil, errors.New("Could not get public paddle key")
+// rotateKeyHandler promotes the key identified by the "kid" form field to
+// primary. The previous primary stays in keySet as verify-only, so licenses
+// it already signed keep validating.
+func rotateKeyHandler(keySet *KeySet, adminToken string, w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(r, adminToken) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "failed to parse formdata", http.StatusBadRequest)
+		return
+	}
+
+	kid := r.FormValue("kid")
+	if kid == "" {
+		http.Error(w, "missing kid field", http.StatusBadRequest)
+		return
 	}
 
-	return key, nil
+	if err := keySet.Rotate(kid); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "rotated to %s", kid)
+}
+
+// checkAdminToken reports whether r carries the admin bearer token. Uses a
+// constant-time comparison, since this token gates /v1/revoke,
+// /v1/keys/rotate and /v1/orders/{id} (which can trigger arbitrary email
+// resends).
+func checkAdminToken(r *http.Request, adminToken string) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	token := strings.TrimPrefix(auth, prefix)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
 }
 
-// Adapted from:
-// https://gist.github.com/haseebq/adc51aaeb4e612c205291a411a7a8872#file-paddle_hook_verify-go
-func verifyPaddleSig(values url.Values, signingKey *rsa.PublicKey) error {
-	sig, err := base64.StdEncoding.DecodeString(values.Get("p_signature"))
+// RevocationList is a persisted, append-only list of revoked order IDs.
+type RevocationList struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newRevocationList(path string) *RevocationList {
+	return &RevocationList{path: path}
+}
+
+// Revoke appends orderId to the list. Revoking the same order ID twice is
+// harmless: IsRevoked only checks for presence.
+func (l *RevocationList) Revoke(orderId string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, orderId)
+	return err
+}
+
+func (l *RevocationList) IsRevoked(orderId string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	// Delete p_signature
-	values.Del("p_signature")
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
 
-	// Sort the keys
-	sortedKeys := make([]string, 0, len(values))
-	for k := range values {
-		sortedKeys = append(sortedKeys, k)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == orderId {
+			return true, nil
+		}
 	}
-	sort.Strings(sortedKeys)
+	return false, nil
+}
 
-	// Php Serialize in sorted order
-	var sbuf bytes.Buffer
-	sbuf.WriteString("a:")
-	sbuf.WriteString(strconv.Itoa(len(sortedKeys)))
-	sbuf.WriteString(":{")
-	encodeString := func(s string) {
-		sbuf.WriteString("s:")
-		sbuf.WriteString(strconv.Itoa(len(s)))
-		sbuf.WriteString(":\"")
-		sbuf.WriteString(s)
-		sbuf.WriteString("\";")
+// tierForProduct maps an order's product ID to a license tier, using the
+// ELM_PAIR_LICENSING_SERVER_PRODUCT_TIERS env var (a comma-separated list of
+// productId=tier pairs). Unknown or unmapped products default to personal.
+func tierForProduct(productId string) string {
+	mapping := os.Getenv("ELM_PAIR_LICENSING_SERVER_PRODUCT_TIERS")
+	for _, pair := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 && parts[0] == productId {
+			return parts[1]
+		}
 	}
-	for _, k := range sortedKeys {
-		encodeString(k)
-		encodeString(values.Get(k))
+	return TierPersonal
+}
+
+// tierLimits is the seat count and feature set each tier carries. Unknown
+// tiers (e.g. a stale ELM_PAIR_LICENSING_SERVER_PRODUCT_TIERS mapping) fall
+// back to the personal limits.
+var tierLimits = map[string]struct {
+	Seats    int
+	Features []string
+}{
+	TierPersonal:   {Seats: 1, Features: nil},
+	TierTeam:       {Seats: 5, Features: []string{"team-management"}},
+	TierEnterprise: {Seats: 50, Features: []string{"team-management", "sso", "priority-support"}},
+}
+
+// newLicense builds the License embedded in a v2 license key, valid for
+// licenseValidityPeriod from issuedAt. Seats and Features follow tier via
+// tierLimits.
+func newLicense(orderId string, issuedAt time.Time, tier string) licensecheck.License {
+	limits, ok := tierLimits[tier]
+	if !ok {
+		limits = tierLimits[TierPersonal]
 	}
-	sbuf.WriteString("}")
 
-	sha1Sum := sha1.Sum(sbuf.Bytes())
-	err = rsa.VerifyPKCS1v15(signingKey, crypto.SHA1, sha1Sum[:], sig)
+	return licensecheck.License{
+		OrderID:   orderId,
+		IssuedAt:  issuedAt.Unix(),
+		ExpiresAt: issuedAt.Add(licenseValidityPeriod).Unix(),
+		Tier:      tier,
+		Seats:     limits.Seats,
+		Features:  limits.Features,
+	}
+}
+
+// generateLicenseKeyV2 signs license with key and encodes it as
+// "v2-<payload>.<sig>", where payload and sig are base64url-encoded JSON and
+// Ed25519 signature respectively. The payload embeds key's kid, so a
+// verifier can look up the right public key to check the signature against
+// even after the server has since rotated to a different primary key. The
+// JSON encoding of License is deterministic because struct fields always
+// marshal in declaration order.
+func generateLicenseKeyV2(key *SigningKey, license licensecheck.License) (string, error) {
+	license.KeyID = key.KID
+
+	payload, err := json.Marshal(license)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	sig := ed25519.Sign(key.Private, payload)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	encodedSig := base64.RawURLEncoding.EncodeToString(sig)
+	return fmt.Sprintf("v2-%s.%s", encodedPayload, encodedSig), nil
+}
+
+type Responder struct {
+	writer             http.ResponseWriter
+	httpClient         http.Client
+	healthChecksIoUuid string
+}
+
+// success pings healthchecks.io asynchronously, so a slow ping doesn't
+// inflate the response latency the logging middleware measures.
+func (w Responder) success(res string) {
+	go func() {
+		url := fmt.Sprintf("https://hc-ping.com/%s", w.healthChecksIoUuid)
+		if _, err := w.httpClient.Head(url); err != nil {
+			log.Println(err)
+		}
+	}()
+	fmt.Fprintf(w.writer, "%s", res)
+}
+
+func (w Responder) error(msg string) {
+	go func() {
+		url := fmt.Sprintf("https://hc-ping.com/%s/fail", w.healthChecksIoUuid)
+		log.Println(url)
+		if _, err := w.httpClient.Post(url, "text/plain;charset=UTF-8", bytes.NewBuffer([]byte(msg))); err != nil {
+			log.Println(err)
+		}
+	}()
+	http.Error(w.writer, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// generateLicenseKey signs a legacy v1 license key with key, prefixing it
+// with key's kid so a verifier knows which key to check the signature
+// against after a rotation.
+func generateLicenseKey(key *SigningKey, orderId string, orderTime time.Time) (string, error) {
+	licenseVersion := 1
+	licenseKey := fmt.Sprintf("%d-%s-%s-%d", licenseVersion, key.KID, orderId, orderTime.Unix())
+	signature := ed25519.Sign(key.Private, []byte(licenseKey))
+
+	encodedSignature := base64.StdEncoding.EncodeToString(signature)
+	return fmt.Sprintf("%s-%s", licenseKey, encodedSignature), nil
 }
@@ -1,20 +1,15 @@
 package main
 
 import (
-	"os"
+	"crypto/ed25519"
 	"testing"
 	"time"
 )
 
 func TestGenerateLicenseKey(t *testing.T) {
-	signingKeyPem, err := os.ReadFile("testing_private_signing_key.pem")
-	if err != nil {
-		t.Errorf("Failed to read private key from file: %s", err)
-	}
-
-	signingKey, err := parsePrivateKey(signingKeyPem)
-	if err != nil {
-		t.Errorf("Failed to read private key: %s", err)
+	signingKey := &SigningKey{
+		KID:     "test",
+		Private: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
 	}
 
 	orderId := "123"
@@ -24,7 +19,7 @@ func TestGenerateLicenseKey(t *testing.T) {
 		t.Errorf("Failed to read generate license key: %s", err)
 	}
 
-	expectedKey := "1-123-1334910171-ttB5QH9dWQjx2bN04PVFnqaAa3Ne7DzEN53S17rMD8BzMPGfZzoPc53HsZXyfzwl1CibJBMW03U0hGXEyyteCw=="
+	expectedKey := "1-test-123-1334910171-VWlDPkFgldiaeMayRUuexsPjFIPWYviqz3Y3wu7DW8+6wZqE56ArP2onHJaDiePVi92qJ6CVW9MLol6OGpOWCw=="
 	if licenseKey != expectedKey {
 		t.Errorf("got license key %s, expected %s", licenseKey, expectedKey)
 	}
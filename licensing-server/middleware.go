@@ -0,0 +1,248 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRateLimitPerSecond = 2.0
+	defaultRateLimitBurst     = 10
+	defaultRateLimitMaxIPs    = 10000
+)
+
+// requestEvent is the structured log line emitted once per request.
+type requestEvent struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+	RemoteIP   string  `json:"remoteIp"`
+	RequestID  string  `json:"requestId"`
+	OrderID    string  `json:"orderId,omitempty"`
+	Provider   string  `json:"provider,omitempty"`
+}
+
+// LogSink receives one requestEvent per handled request. Tests can swap in
+// their own sink to assert on what gets logged instead of parsing stdout.
+type LogSink interface {
+	Log(event requestEvent)
+}
+
+type logInfoKeyType struct{}
+
+// logInfoKey is the context key withRateLimitAndLogging stores a
+// *requestLogInfo under, for handlers to fill in via setRequestLogInfo.
+var logInfoKey = logInfoKeyType{}
+
+// requestLogInfo carries the provider and order ID a webhook handler
+// resolved for a request, so withRateLimitAndLogging can log them without
+// having to guess them from the request path.
+type requestLogInfo struct {
+	mu       sync.Mutex
+	provider string
+	orderID  string
+}
+
+// setRequestLogInfo records the provider and order ID a webhook handler
+// resolved for r, for withRateLimitAndLogging to include in its log line.
+// It's a no-op if r wasn't routed through withRateLimitAndLogging.
+func setRequestLogInfo(r *http.Request, provider, orderID string) {
+	info, ok := r.Context().Value(logInfoKey).(*requestLogInfo)
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.provider = provider
+	info.orderID = orderID
+}
+
+// StdoutLogSink writes each requestEvent as a JSON line to stdout.
+type StdoutLogSink struct{}
+
+func (StdoutLogSink) Log(event requestEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// withRateLimitAndLogging wraps next with per-IP token-bucket rate limiting
+// and structured per-request logging.
+func withRateLimitAndLogging(limiter *ipRateLimiter, sink LogSink, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" {
+			requestId = generateRequestID()
+		}
+
+		if !limiter.allow(ip) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			sink.Log(requestEvent{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Status:    http.StatusTooManyRequests,
+				RemoteIP:  ip,
+				RequestID: requestId,
+			})
+			return
+		}
+
+		info := &requestLogInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), logInfoKey, info))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		info.mu.Lock()
+		provider, orderID := info.provider, info.orderID
+		info.mu.Unlock()
+
+		event := requestEvent{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     recorder.status,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			RemoteIP:   ip,
+			RequestID:  requestId,
+			OrderID:    orderID,
+			Provider:   provider,
+		}
+
+		sink.Log(event)
+	})
+}
+
+// statusRecorder captures the status code a handler wrote, for logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// remoteIP extracts the client IP from r.RemoteAddr, dropping the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// generateRequestID returns a random hex request ID for requests that
+// didn't arrive with an X-Request-Id header already set.
+func generateRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// limiterEntry pairs a remote IP with its rate.Limiter, for the LRU in
+// ipRateLimiter.
+type limiterEntry struct {
+	ip      string
+	limiter *rate.Limiter
+}
+
+// ipRateLimiter hands out a token-bucket rate.Limiter per remote IP. The
+// number of limiters kept alive is bounded by an LRU, so memory doesn't
+// grow without limit when many distinct IPs show up.
+type ipRateLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	maxSize  int
+	order    *list.List
+	limiters map[string]*list.Element
+}
+
+func newIPRateLimiter(limit rate.Limit, burst, maxSize int) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:    limit,
+		burst:    burst,
+		maxSize:  maxSize,
+		order:    list.New(),
+		limiters: make(map[string]*list.Element),
+	}
+}
+
+func (l *ipRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, ok := l.limiters[ip]; ok {
+		l.order.MoveToFront(elem)
+		return elem.Value.(*limiterEntry).limiter.Allow()
+	}
+
+	entry := &limiterEntry{ip: ip, limiter: rate.NewLimiter(l.limit, l.burst)}
+	l.limiters[ip] = l.order.PushFront(entry)
+
+	if l.order.Len() > l.maxSize {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.limiters, oldest.Value.(*limiterEntry).ip)
+	}
+
+	return entry.limiter.Allow()
+}
+
+// rateLimiterFromEnv builds the ipRateLimiter, reading its rate, burst and
+// tracked-IP cap from env vars, each with a sane default so the feature
+// works out of the box.
+func rateLimiterFromEnv() (*ipRateLimiter, error) {
+	perSecond := defaultRateLimitPerSecond
+	if v := os.Getenv("ELM_PAIR_LICENSING_SERVER_RATE_LIMIT_PER_SECOND"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ELM_PAIR_LICENSING_SERVER_RATE_LIMIT_PER_SECOND: %w", err)
+		}
+		perSecond = parsed
+	}
+
+	burst := defaultRateLimitBurst
+	if v := os.Getenv("ELM_PAIR_LICENSING_SERVER_RATE_LIMIT_BURST"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ELM_PAIR_LICENSING_SERVER_RATE_LIMIT_BURST: %w", err)
+		}
+		burst = parsed
+	}
+
+	maxIPs := defaultRateLimitMaxIPs
+	if v := os.Getenv("ELM_PAIR_LICENSING_SERVER_RATE_LIMIT_MAX_IPS"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ELM_PAIR_LICENSING_SERVER_RATE_LIMIT_MAX_IPS: %w", err)
+		}
+		maxIPs = parsed
+	}
+
+	return newIPRateLimiter(rate.Limit(perSecond), burst, maxIPs), nil
+}
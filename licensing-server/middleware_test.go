@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestIPRateLimiterAllowsBurstThenBlocks(t *testing.T) {
+	limiter := newIPRateLimiter(rate.Limit(0.001), 2, 10)
+
+	if !limiter.allow("a") {
+		t.Error("expected first request within burst to be allowed")
+	}
+	if !limiter.allow("a") {
+		t.Error("expected second request within burst to be allowed")
+	}
+	if limiter.allow("a") {
+		t.Error("expected third request to exceed burst and be blocked")
+	}
+}
+
+func TestIPRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	limiter := newIPRateLimiter(rate.Limit(1), 1, 2)
+
+	limiter.allow("a")
+	limiter.allow("b")
+	if len(limiter.limiters) != 2 {
+		t.Fatalf("got %d tracked IPs, want 2", len(limiter.limiters))
+	}
+
+	limiter.allow("c")
+	if len(limiter.limiters) != 2 {
+		t.Fatalf("got %d tracked IPs after eviction, want 2", len(limiter.limiters))
+	}
+	if _, ok := limiter.limiters["a"]; ok {
+		t.Error("expected IP a to have been evicted as least recently used")
+	}
+	if _, ok := limiter.limiters["b"]; !ok {
+		t.Error("expected IP b to still be tracked")
+	}
+	if _, ok := limiter.limiters["c"]; !ok {
+		t.Error("expected IP c to be tracked")
+	}
+}
+
+func TestIPRateLimiterMovesRecentlyUsedToFront(t *testing.T) {
+	limiter := newIPRateLimiter(rate.Limit(1), 1, 2)
+
+	limiter.allow("a")
+	limiter.allow("b")
+	limiter.allow("a") // touch a, so b becomes least recently used
+	limiter.allow("c") // should evict b, not a
+
+	if _, ok := limiter.limiters["a"]; !ok {
+		t.Error("expected IP a to still be tracked after being touched")
+	}
+	if _, ok := limiter.limiters["b"]; ok {
+		t.Error("expected IP b to have been evicted as least recently used")
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// OrderRecord is what a Store persists for each order a license was issued
+// for, so repeated webhook deliveries can be served idempotently and
+// support can look up what a buyer was sent.
+type OrderRecord struct {
+	LicenseKey string    `json:"licenseKey"`
+	IssuedAt   time.Time `json:"issuedAt"`
+	Email      string    `json:"email"`
+	Provider   string    `json:"provider"`
+	RawWebhook []byte    `json:"rawWebhook"`
+}
+
+// Store persists OrderRecords keyed by order ID.
+type Store interface {
+	Get(orderId string) (OrderRecord, bool, error)
+	Put(orderId string, record OrderRecord) error
+}
+
+// newStoreFromEnv builds the Store configured by
+// ELM_PAIR_LICENSING_SERVER_STORE_BACKEND ("bolt", the default, or "s3").
+func newStoreFromEnv() (Store, error) {
+	switch backend := os.Getenv("ELM_PAIR_LICENSING_SERVER_STORE_BACKEND"); backend {
+	case "", "bolt":
+		path := os.Getenv("ELM_PAIR_LICENSING_SERVER_STORE_PATH")
+		if path == "" {
+			return nil, errors.New("not set: ELM_PAIR_LICENSING_SERVER_STORE_PATH")
+		}
+		return newBoltStore(path)
+	case "s3":
+		bucket := os.Getenv("ELM_PAIR_LICENSING_SERVER_S3_BUCKET")
+		region := os.Getenv("ELM_PAIR_LICENSING_SERVER_S3_REGION")
+		accessKeyId := os.Getenv("ELM_PAIR_LICENSING_SERVER_S3_ACCESS_KEY_ID")
+		secretAccessKey := os.Getenv("ELM_PAIR_LICENSING_SERVER_S3_SECRET_ACCESS_KEY")
+		if bucket == "" || region == "" || accessKeyId == "" || secretAccessKey == "" {
+			return nil, errors.New("s3 store backend requires ELM_PAIR_LICENSING_SERVER_S3_BUCKET, _S3_REGION, _S3_ACCESS_KEY_ID and _S3_SECRET_ACCESS_KEY")
+		}
+		return newS3Store(bucket, region, accessKeyId, secretAccessKey), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend: %s", backend)
+	}
+}
+
+// ordersBucket is the bbolt bucket OrderRecords are stored in.
+var ordersBucket = []byte("orders")
+
+// BoltStore is the default file-backed Store, suitable for a single
+// licensing server instance.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func newBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ordersBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(orderId string) (OrderRecord, bool, error) {
+	var record OrderRecord
+	found := false
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(ordersBucket).Get([]byte(orderId))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &record)
+	})
+
+	return record, found, err
+}
+
+func (s *BoltStore) Put(orderId string, record OrderRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(ordersBucket).Put([]byte(orderId), data)
+	})
+}
+
+// S3Store persists OrderRecords as JSON objects in an S3 bucket, under
+// orders/<orderId>.json, so multiple licensing server instances can share
+// one ledger. Requests are signed with AWS Signature Version 4 directly,
+// rather than pulling in the AWS SDK.
+type S3Store struct {
+	httpClient      http.Client
+	bucket          string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+}
+
+func newS3Store(bucket, region, accessKeyId, secretAccessKey string) *S3Store {
+	return &S3Store{
+		httpClient:      http.Client{Timeout: 10 * time.Second},
+		bucket:          bucket,
+		region:          region,
+		accessKeyId:     accessKeyId,
+		secretAccessKey: secretAccessKey,
+	}
+}
+
+func (s *S3Store) Get(orderId string) (OrderRecord, bool, error) {
+	var record OrderRecord
+
+	req, err := s.signedRequest(http.MethodGet, orderId, nil)
+	if err != nil {
+		return record, false, err
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return record, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return record, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return record, false, fmt.Errorf("s3 get failed with status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+func (s *S3Store) Put(orderId string, record OrderRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.signedRequest(http.MethodPut, orderId, data)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 put failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signedRequest builds an AWS Signature Version 4 signed request for the
+// orders/<orderId>.json object.
+func (s *S3Store) signedRequest(method, orderId string, body []byte) (*http.Request, error) {
+	host := fmt.Sprintf("%s.s3.%s.amazonaws.com", s.bucket, s.region)
+	canonicalURI := fmt.Sprintf("/orders/%s.json", url.PathEscape(orderId))
+
+	req, err := http.NewRequest(method, fmt.Sprintf("https://%s%s", host, canonicalURI), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", host)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", host, payloadHash, amzDate)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	credentialScope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, s.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		credentialScope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := s3SigningKey(s.secretAccessKey, dateStamp, s.region)
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyId, credentialScope, signedHeaders, signature,
+	))
+
+	return req, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3SigningKey(secretAccessKey, dateStamp, region string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+secretAccessKey), dateStamp)
+	kRegion := hmacSHA256(kDate, region)
+	kService := hmacSHA256(kRegion, "s3")
+	return hmacSHA256(kService, "aws4_request")
+}
+
+// Mailer delivers a license key to a buyer's email address.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NoopMailer discards mail, for use in tests and dev workflows that haven't
+// configured SMTP.
+type NoopMailer struct{}
+
+func (NoopMailer) Send(to, subject, body string) error {
+	return nil
+}
+
+// SMTPMailer sends mail through an SMTP relay.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// newMailerFromEnv returns an SMTPMailer configured from
+// ELM_PAIR_LICENSING_SERVER_SMTP_* env vars, or a NoopMailer if SMTP isn't
+// configured, so local dev and tests work without a mail relay.
+func newMailerFromEnv() (Mailer, error) {
+	host := os.Getenv("ELM_PAIR_LICENSING_SERVER_SMTP_HOST")
+	if host == "" {
+		return NoopMailer{}, nil
+	}
+
+	from := os.Getenv("ELM_PAIR_LICENSING_SERVER_SMTP_FROM")
+	if from == "" {
+		return nil, errors.New("not set: ELM_PAIR_LICENSING_SERVER_SMTP_FROM")
+	}
+
+	port := os.Getenv("ELM_PAIR_LICENSING_SERVER_SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	username := os.Getenv("ELM_PAIR_LICENSING_SERVER_SMTP_USERNAME")
+	password := os.Getenv("ELM_PAIR_LICENSING_SERVER_SMTP_PASSWORD")
+
+	return &SMTPMailer{
+		addr: fmt.Sprintf("%s:%s", host, port),
+		from: from,
+		auth: smtp.PlainAuth("", username, password, host),
+	}, nil
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.from, to, subject, body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+// sendLicenseEmailWithRetry emails licenseKey to to, retrying transient
+// failures with exponential backoff.
+func sendLicenseEmailWithRetry(mailer Mailer, to, licenseKey string) error {
+	const maxAttempts = 5
+	backoff := time.Second
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = mailer.Send(to, "Your Elm-pair license key", licenseKey)
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("failed to send license email (attempt %d/%d): %s", attempt, maxAttempts, err)
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
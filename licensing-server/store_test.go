@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBoltStoreGetPutRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newBoltStore(filepath.Join(dir, "orders.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	if _, found, err := store.Get("missing"); err != nil || found {
+		t.Fatalf("got found=%v err=%v for a missing order, want found=false err=nil", found, err)
+	}
+
+	record := OrderRecord{LicenseKey: "v2-abc.def", Email: "buyer@example.com", Provider: "paddle"}
+	if err := store.Put("order_1", record); err != nil {
+		t.Fatalf("failed to put record: %s", err)
+	}
+
+	got, found, err := store.Get("order_1")
+	if err != nil || !found {
+		t.Fatalf("got found=%v err=%v for order_1, want found=true err=nil", found, err)
+	}
+	if got.LicenseKey != record.LicenseKey || got.Email != record.Email || got.Provider != record.Provider {
+		t.Errorf("got record %+v, want %+v", got, record)
+	}
+}
+
+// slowStore is an in-memory Store with a sleep in Get, to widen the race
+// window a missing per-order lock would otherwise leave open.
+type slowStore struct {
+	mu      sync.Mutex
+	records map[string]OrderRecord
+	puts    int
+}
+
+func newSlowStore() *slowStore {
+	return &slowStore{records: make(map[string]OrderRecord)}
+}
+
+func (s *slowStore) Get(orderId string) (OrderRecord, bool, error) {
+	time.Sleep(time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, found := s.records[orderId]
+	return record, found, nil
+}
+
+func (s *slowStore) Put(orderId string, record OrderRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[orderId] = record
+	s.puts++
+	return nil
+}
+
+func TestIssueLicenseLockedSerializesConcurrentDelivery(t *testing.T) {
+	priv := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	signingKey := &SigningKey{KID: "test", Private: priv, Public: priv.Public().(ed25519.PublicKey)}
+	keySet := &KeySet{keys: map[string]*SigningKey{"test": signingKey}, primaryKID: "test"}
+
+	store := newSlowStore()
+	event := OrderEvent{OrderID: "order_1", EventTime: time.Now(), Email: "buyer@example.com"}
+	req := httptest.NewRequest(http.MethodPost, "/v1/webhooks/paddle/generate-license-key", nil)
+
+	const deliveries = 20
+	results := make([]string, deliveries)
+	var wg sync.WaitGroup
+	wg.Add(deliveries)
+	for i := 0; i < deliveries; i++ {
+		go func(i int) {
+			defer wg.Done()
+			licenseKey, _, err := issueLicenseLocked(keySet, store, "paddle", event, req)
+			if err != nil {
+				t.Errorf("delivery %d: unexpected error: %s", i, err)
+				return
+			}
+			results[i] = licenseKey
+		}(i)
+	}
+	wg.Wait()
+
+	if store.puts != 1 {
+		t.Errorf("got %d store.Put calls, want exactly 1", store.puts)
+	}
+	for i, key := range results {
+		if key != results[0] {
+			t.Errorf("delivery %d got license key %s, want %s (same as delivery 0)", i, key, results[0])
+		}
+	}
+}
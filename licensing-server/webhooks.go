@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OrderEvent is the normalized result of verifying an inbound payment
+// webhook, regardless of which provider sent it.
+type OrderEvent struct {
+	OrderID   string
+	EventTime time.Time
+	Email     string
+	ProductID string
+	Raw       []byte
+}
+
+// WebhookVerifier authenticates an inbound payment webhook request and
+// extracts the order it describes.
+type WebhookVerifier interface {
+	Verify(r *http.Request) (OrderEvent, error)
+}
+
+// ErrIgnoredEvent is returned by a WebhookVerifier for a validly-signed
+// webhook whose event type isn't a completed purchase (a refund, a failed
+// payment, a subscription cancellation, ...). Unlike Paddle, which has a
+// separate webhook URL per event, Stripe and Lemon Squeezy send every event
+// type to the same URL, so verifiers must filter these out themselves
+// rather than minting a license for them.
+var ErrIgnoredEvent = errors.New("event type is not a completed purchase")
+
+// PaddleVerifier checks Paddle's PHP-serialize + RSA-SHA1 webhook signature.
+type PaddleVerifier struct {
+	Key *rsa.PublicKey
+}
+
+func (v PaddleVerifier) Verify(r *http.Request) (OrderEvent, error) {
+	if err := r.ParseForm(); err != nil {
+		return OrderEvent{}, fmt.Errorf("failed to parse formdata: %w", err)
+	}
+
+	if err := verifyPaddleSig(r.Form, v.Key); err != nil {
+		return OrderEvent{}, fmt.Errorf("invalid paddle signature: %w", err)
+	}
+
+	eventTimeStr := r.FormValue("event_time")
+	if eventTimeStr == "" {
+		return OrderEvent{}, errors.New("missing event_time field")
+	}
+
+	eventTime, err := time.Parse("2006-01-02 15:04:05", eventTimeStr)
+	if err != nil {
+		return OrderEvent{}, fmt.Errorf("failed to parse event_time %s: %w", eventTimeStr, err)
+	}
+
+	return OrderEvent{
+		OrderID:   r.FormValue("p_order_id"),
+		EventTime: eventTime,
+		Email:     r.FormValue("email"),
+		ProductID: r.FormValue("p_product_id"),
+		Raw:       []byte(r.Form.Encode()),
+	}, nil
+}
+
+// readPaddleKeyFromEnv reads the RSA public key Paddle signs webhooks with.
+func readPaddleKeyFromEnv() (*rsa.PublicKey, error) {
+	keyPem := os.Getenv("ELM_PAIR_LICENSING_SERVER_PADDLE_KEY")
+	if keyPem == "" {
+		return nil, errors.New("not set: ELM_PAIR_LICENSING_SERVER_PADDLE_KEY")
+	}
+
+	keyX509, _ := pem.Decode([]byte(keyPem))
+	if keyX509 == nil {
+		return nil, errors.New("Could not parse paddle key pem")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(keyX509.Bytes)
+	if err != nil {
+		return nil, errors.New("Could not parse paddle key x509")
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Could not get public paddle key")
+	}
+
+	return key, nil
+}
+
+// Adapted from:
+// https://gist.github.com/haseebq/adc51aaeb4e612c205291a411a7a8872#file-paddle_hook_verify-go
+func verifyPaddleSig(values url.Values, signingKey *rsa.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(values.Get("p_signature"))
+	if err != nil {
+		return err
+	}
+
+	// Delete p_signature
+	values.Del("p_signature")
+
+	// Sort the keys
+	sortedKeys := make([]string, 0, len(values))
+	for k := range values {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+
+	// Php Serialize in sorted order
+	var sbuf bytes.Buffer
+	sbuf.WriteString("a:")
+	sbuf.WriteString(strconv.Itoa(len(sortedKeys)))
+	sbuf.WriteString(":{")
+	encodeString := func(s string) {
+		sbuf.WriteString("s:")
+		sbuf.WriteString(strconv.Itoa(len(s)))
+		sbuf.WriteString(":\"")
+		sbuf.WriteString(s)
+		sbuf.WriteString("\";")
+	}
+	for _, k := range sortedKeys {
+		encodeString(k)
+		encodeString(values.Get(k))
+	}
+	sbuf.WriteString("}")
+
+	sha1Sum := sha1.Sum(sbuf.Bytes())
+	err = rsa.VerifyPKCS1v15(signingKey, crypto.SHA1, sha1Sum[:], sig)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// StripeVerifier checks Stripe's HMAC-SHA256 webhook signature, as found in
+// the Stripe-Signature header (format "t=<timestamp>,v1=<sig>[,v1=<sig>...]").
+// Tolerance bounds how old an event's timestamp may be, to reject replays.
+type StripeVerifier struct {
+	Secret    string
+	Tolerance time.Duration
+}
+
+// stripeEventTypePaid is the only Stripe event type that represents a
+// completed purchase; everything else arriving at the shared webhook URL
+// (refunds, failed payments, subscription cancellations, disputes, ...) is
+// ignored.
+const stripeEventTypePaid = "checkout.session.completed"
+
+type stripeEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			ID                string            `json:"id"`
+			ClientReferenceID string            `json:"client_reference_id"`
+			CustomerEmail     string            `json:"customer_email"`
+			Created           int64             `json:"created"`
+			Metadata          map[string]string `json:"metadata"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+func (v StripeVerifier) Verify(r *http.Request) (OrderEvent, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return OrderEvent{}, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	timestamp, sig, err := parseStripeSignatureHeader(r.Header.Get("Stripe-Signature"))
+	if err != nil {
+		return OrderEvent{}, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(v.Secret))
+	fmt.Fprintf(mac, "%d.%s", timestamp, body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return OrderEvent{}, errors.New("invalid stripe signature")
+	}
+
+	eventTime := time.Unix(timestamp, 0)
+	if time.Since(eventTime) > v.Tolerance {
+		return OrderEvent{}, errors.New("stripe signature timestamp outside tolerance window")
+	}
+
+	var event stripeEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return OrderEvent{}, fmt.Errorf("failed to parse stripe event: %w", err)
+	}
+
+	if event.Type != stripeEventTypePaid {
+		return OrderEvent{}, ErrIgnoredEvent
+	}
+
+	orderId := event.Data.Object.ClientReferenceID
+	if orderId == "" {
+		orderId = event.Data.Object.ID
+	}
+
+	return OrderEvent{
+		OrderID:   orderId,
+		EventTime: time.Unix(event.Data.Object.Created, 0),
+		Email:     event.Data.Object.CustomerEmail,
+		ProductID: event.Data.Object.Metadata["product_id"],
+		Raw:       body,
+	}, nil
+}
+
+// parseStripeSignatureHeader splits a Stripe-Signature header into its
+// timestamp and v1 signature.
+func parseStripeSignatureHeader(header string) (int64, string, error) {
+	var timestamp int64
+	var sig string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			t, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return 0, "", fmt.Errorf("invalid stripe signature timestamp: %w", err)
+			}
+			timestamp = t
+		case "v1":
+			sig = kv[1]
+		}
+	}
+
+	if timestamp == 0 || sig == "" {
+		return 0, "", errors.New("missing t or v1 in Stripe-Signature header")
+	}
+
+	return timestamp, sig, nil
+}
+
+// LemonSqueezyVerifier checks Lemon Squeezy's HMAC-SHA256 webhook signature,
+// sent in the X-Signature header as a hex digest of the raw request body.
+type LemonSqueezyVerifier struct {
+	Secret string
+}
+
+// lemonSqueezyEventNamePaid is the only Lemon Squeezy event name that
+// represents a completed purchase; everything else arriving at the shared
+// webhook URL (refunds, subscription cancellations, payment failures, ...)
+// is ignored.
+const lemonSqueezyEventNamePaid = "order_created"
+
+type lemonSqueezyEvent struct {
+	Meta struct {
+		EventName string `json:"event_name"`
+	} `json:"meta"`
+	Data struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			OrderNumber    int    `json:"order_number"`
+			UserEmail      string `json:"user_email"`
+			CreatedAt      string `json:"created_at"`
+			FirstOrderItem struct {
+				ProductID int `json:"product_id"`
+			} `json:"first_order_item"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+func (v LemonSqueezyVerifier) Verify(r *http.Request) (OrderEvent, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return OrderEvent{}, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(v.Secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Signature"))) {
+		return OrderEvent{}, errors.New("invalid lemon squeezy signature")
+	}
+
+	var event lemonSqueezyEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return OrderEvent{}, fmt.Errorf("failed to parse lemon squeezy event: %w", err)
+	}
+
+	if event.Meta.EventName != lemonSqueezyEventNamePaid {
+		return OrderEvent{}, ErrIgnoredEvent
+	}
+
+	eventTime, err := time.Parse(time.RFC3339, event.Data.Attributes.CreatedAt)
+	if err != nil {
+		return OrderEvent{}, fmt.Errorf("failed to parse created_at %s: %w", event.Data.Attributes.CreatedAt, err)
+	}
+
+	return OrderEvent{
+		OrderID:   event.Data.ID,
+		EventTime: eventTime,
+		Email:     event.Data.Attributes.UserEmail,
+		ProductID: strconv.Itoa(event.Data.Attributes.FirstOrderItem.ProductID),
+		Raw:       body,
+	}, nil
+}
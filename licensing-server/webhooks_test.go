@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newStripeRequest(secret string, body []byte, eventTime time.Time) *http.Request {
+	timestamp := eventTime.Unix()
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", timestamp, body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/webhooks/stripe/generate-license-key", bytes.NewReader(body))
+	req.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, sig))
+	return req
+}
+
+func TestStripeVerifierAcceptsCompletedCheckout(t *testing.T) {
+	secret := "whsec_test"
+	body := []byte(`{"type":"checkout.session.completed","data":{"object":{"id":"cs_123","client_reference_id":"order_1","customer_email":"buyer@example.com","created":1700000000,"metadata":{"product_id":"prod_1"}}}}`)
+	req := newStripeRequest(secret, body, time.Now())
+
+	verifier := StripeVerifier{Secret: secret, Tolerance: 5 * time.Minute}
+	event, err := verifier.Verify(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if event.OrderID != "order_1" {
+		t.Errorf("got order id %s, want order_1", event.OrderID)
+	}
+	if event.Email != "buyer@example.com" {
+		t.Errorf("got email %s, want buyer@example.com", event.Email)
+	}
+	if event.ProductID != "prod_1" {
+		t.Errorf("got product id %s, want prod_1", event.ProductID)
+	}
+}
+
+func TestStripeVerifierIgnoresNonPurchaseEvents(t *testing.T) {
+	secret := "whsec_test"
+	body := []byte(`{"type":"charge.refunded","data":{"object":{"id":"ch_123"}}}`)
+	req := newStripeRequest(secret, body, time.Now())
+
+	verifier := StripeVerifier{Secret: secret, Tolerance: 5 * time.Minute}
+	if _, err := verifier.Verify(req); !errors.Is(err, ErrIgnoredEvent) {
+		t.Fatalf("got error %v, want ErrIgnoredEvent", err)
+	}
+}
+
+func TestStripeVerifierRejectsBadSignature(t *testing.T) {
+	secret := "whsec_test"
+	body := []byte(`{"type":"checkout.session.completed","data":{"object":{"id":"cs_123"}}}`)
+	req := newStripeRequest("wrong-secret", body, time.Now())
+
+	verifier := StripeVerifier{Secret: secret, Tolerance: 5 * time.Minute}
+	if _, err := verifier.Verify(req); err == nil {
+		t.Fatal("expected an error for a bad signature")
+	}
+}
+
+func TestStripeVerifierRejectsStaleTimestamp(t *testing.T) {
+	secret := "whsec_test"
+	body := []byte(`{"type":"checkout.session.completed","data":{"object":{"id":"cs_123"}}}`)
+	req := newStripeRequest(secret, body, time.Now().Add(-time.Hour))
+
+	verifier := StripeVerifier{Secret: secret, Tolerance: 5 * time.Minute}
+	if _, err := verifier.Verify(req); err == nil {
+		t.Fatal("expected an error for a signature timestamp outside the tolerance window")
+	}
+}
+
+func newLemonSqueezyRequest(secret string, body []byte) *http.Request {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/webhooks/lemonsqueezy/generate-license-key", bytes.NewReader(body))
+	req.Header.Set("X-Signature", sig)
+	return req
+}
+
+func TestLemonSqueezyVerifierAcceptsOrderCreated(t *testing.T) {
+	secret := "ls_secret"
+	body := []byte(`{"meta":{"event_name":"order_created"},"data":{"id":"456","attributes":{"user_email":"buyer@example.com","created_at":"2024-01-02T03:04:05Z","first_order_item":{"product_id":7}}}}`)
+	req := newLemonSqueezyRequest(secret, body)
+
+	verifier := LemonSqueezyVerifier{Secret: secret}
+	event, err := verifier.Verify(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if event.OrderID != "456" {
+		t.Errorf("got order id %s, want 456", event.OrderID)
+	}
+	if event.ProductID != "7" {
+		t.Errorf("got product id %s, want 7", event.ProductID)
+	}
+}
+
+func TestLemonSqueezyVerifierIgnoresNonPurchaseEvents(t *testing.T) {
+	secret := "ls_secret"
+	body := []byte(`{"meta":{"event_name":"order_refunded"},"data":{"id":"456"}}`)
+	req := newLemonSqueezyRequest(secret, body)
+
+	verifier := LemonSqueezyVerifier{Secret: secret}
+	if _, err := verifier.Verify(req); !errors.Is(err, ErrIgnoredEvent) {
+		t.Fatalf("got error %v, want ErrIgnoredEvent", err)
+	}
+}
+
+func TestLemonSqueezyVerifierRejectsBadSignature(t *testing.T) {
+	secret := "ls_secret"
+	body := []byte(`{"meta":{"event_name":"order_created"},"data":{"id":"456"}}`)
+	req := httptest.NewRequest(http.MethodPost, "/v1/webhooks/lemonsqueezy/generate-license-key", bytes.NewReader(body))
+	req.Header.Set("X-Signature", "deadbeef")
+
+	verifier := LemonSqueezyVerifier{Secret: secret}
+	if _, err := verifier.Verify(req); err == nil {
+		t.Fatal("expected an error for a bad signature")
+	}
+}